@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Channel is a named logical broadcast group that connections can join and publish to
+type Channel struct {
+	id      string
+	members map[net.Conn]struct{}
+}
+
+// Returns an initialized instance of *Channel
+func NewChannel(id string) *Channel {
+	return &Channel{
+		id:      id,
+		members: make(map[net.Conn]struct{}),
+	}
+}
+
+// errChannelIDTooLong is returned when encoding a channel envelope with an id longer than 255 bytes
+var errChannelIDTooLong = errors.New("channel id exceeds 255 bytes")
+
+// encodeChannelEnvelope prefixes data with a one-byte length and the channel id, the payload
+// format shared by CodeJoin, CodeLeave and CodePublish
+func encodeChannelEnvelope(id string, data []byte) ([]byte, error) {
+	if len(id) > 0xff {
+		return nil, errChannelIDTooLong
+	}
+	envelope := make([]byte, 1+len(id)+len(data))
+	envelope[0] = byte(len(id))
+	copy(envelope[1:], id)
+	copy(envelope[1+len(id):], data)
+	return envelope, nil
+}
+
+// decodeChannelEnvelope splits a channel envelope back into its channel id and data
+func decodeChannelEnvelope(envelope []byte) (id string, data []byte, err error) {
+	if len(envelope) < 1 {
+		return "", nil, fmt.Errorf("channel envelope too short")
+	}
+	idLen := int(envelope[0])
+	if len(envelope) < 1+idLen {
+		return "", nil, fmt.Errorf("channel envelope truncated")
+	}
+	return string(envelope[1 : 1+idLen]), envelope[1+idLen:], nil
+}
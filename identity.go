@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// protocolVersion is the handshake protocol version this server speaks
+const protocolVersion = 1
+
+// nonceSize is the size in bytes of the random nonce the server challenges a connecting peer with
+const nonceSize = 32
+
+// HandshakeTimeout bounds how long the identity handshake may take before the connection is dropped
+const HandshakeTimeout = 5 * time.Second
+
+// ClientIdentity identifies a connected peer by a human-readable name and the public key it proved ownership of
+type ClientIdentity interface {
+	String() string
+	Pubkey() []byte
+}
+
+// clientIdentity is the concrete ClientIdentity resolved from a successful handshake
+type clientIdentity struct {
+	name   string
+	pubkey ed25519.PublicKey
+}
+
+func (c *clientIdentity) String() string { return c.name }
+func (c *clientIdentity) Pubkey() []byte { return c.pubkey }
+
+// identityEquals reports whether a and b are the same identity, compared by public key
+func identityEquals(a, b ClientIdentity) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return bytes.Equal(a.Pubkey(), b.Pubkey())
+}
+
+// HandshakeError is returned when a peer's identity handshake fails, wrapping the underlying cause
+type HandshakeError struct {
+	Reason string
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake failed: %s: %v", e.Reason, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error { return e.Err }
+
+// handshake proves the identity of the connection on the other end of conn before it is trusted:
+// the server sends a random nonce framed as CodeNick, the peer replies in kind with its name,
+// protocol version and Ed25519 public key, plus a signature over the nonce. The server verifies
+// the signature against the claimed public key, resolving a ClientIdentity on success.
+// maxFrameSize bounds the hello frame, matching the limit readMsgLoop enforces on every later
+// frame from this connection.
+// handshake returns the *bufio.Reader it read the hello through; the caller must reuse it for any
+// further reads on conn instead of building a fresh one, since a pipelined frame sent right after
+// the hello may already be sitting in this reader's buffer.
+func handshake(conn net.Conn, maxFrameSize uint32) (ClientIdentity, *bufio.Reader, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, &HandshakeError{Reason: "generating nonce", Err: err}
+	}
+	if err := writeFrame(conn, CodeNick, nonce); err != nil {
+		return nil, nil, &HandshakeError{Reason: "sending nonce", Err: err}
+	}
+
+	r := bufio.NewReader(conn)
+	code, payload, err := readFrame(r, maxFrameSize)
+	if err != nil {
+		return nil, nil, &HandshakeError{Reason: "reading hello", Err: err}
+	}
+	if code != CodeNick {
+		return nil, nil, &HandshakeError{Reason: "unexpected opcode", Err: fmt.Errorf("got code %d, want CodeNick", code)}
+	}
+
+	name, version, pubkey, signature, err := decodeHello(payload)
+	if err != nil {
+		return nil, nil, &HandshakeError{Reason: "decoding hello", Err: err}
+	}
+	if version != protocolVersion {
+		return nil, nil, &HandshakeError{Reason: "version mismatch", Err: fmt.Errorf("got version %d, want %d", version, protocolVersion)}
+	}
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, nil, &HandshakeError{Reason: "invalid public key", Err: fmt.Errorf("got %d bytes, want %d", len(pubkey), ed25519.PublicKeySize)}
+	}
+	if !ed25519.Verify(pubkey, nonce, signature) {
+		return nil, nil, &HandshakeError{Reason: "signature verification", Err: errors.New("signature does not match nonce")}
+	}
+
+	return &clientIdentity{name: name, pubkey: pubkey}, r, nil
+}
+
+// encodeHello builds the framed hello payload a client sends during the handshake:
+// [1 byte name length][name][1 byte version][ed25519 public key][ed25519 signature]
+func encodeHello(name string, version uint8, pubkey ed25519.PublicKey, signature []byte) ([]byte, error) {
+	if len(name) > 0xff {
+		return nil, fmt.Errorf("name exceeds 255 bytes")
+	}
+	payload := make([]byte, 0, 1+len(name)+1+len(pubkey)+len(signature))
+	payload = append(payload, byte(len(name)))
+	payload = append(payload, name...)
+	payload = append(payload, version)
+	payload = append(payload, pubkey...)
+	payload = append(payload, signature...)
+	return payload, nil
+}
+
+// decodeHello parses a hello payload back into its name, protocol version, public key and signature
+func decodeHello(payload []byte) (name string, version uint8, pubkey, signature []byte, err error) {
+	if len(payload) < 1 {
+		return "", 0, nil, nil, fmt.Errorf("hello too short")
+	}
+	nameLen := int(payload[0])
+	offset := 1 + nameLen
+	if len(payload) < offset+1+ed25519.PublicKeySize {
+		return "", 0, nil, nil, fmt.Errorf("hello truncated")
+	}
+	name = string(payload[1:offset])
+	version = payload[offset]
+	offset++
+	pubkey = payload[offset : offset+ed25519.PublicKeySize]
+	offset += ed25519.PublicKeySize
+	signature = payload[offset:]
+	return name, version, pubkey, signature, nil
+}
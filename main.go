@@ -1,108 +1,314 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+)
+
+// defaultMaxFrameSize is the upper bound on a frame body when Server.MaxFrameSize is unset
+const defaultMaxFrameSize = 1 << 20 // 1 MiB
+
+// frameHeaderSize is the size in bytes of the length prefix + opcode that precede every frame body
+const frameHeaderSize = 5 // uint32 length + uint8 code
+
+// outboxCapacity is the size of each peer's bounded outbound queue
+const outboxCapacity = 64
+
+// defaultWriteTimeout bounds how long a writer goroutine waits for a single frame write before
+// giving up on the peer, when Server.WriteTimeout is left zero
+const defaultWriteTimeout = 5 * time.Second
+
+// defaultReadIdleTimeout bounds how long a connection may go without sending a frame before the
+// server pings it, when Server.ReadIdleTimeout is left zero
+const defaultReadIdleTimeout = 60 * time.Second
+
+// defaultKeepAliveInterval is the TCP keepalive probe period applied to accepted connections,
+// when Server.KeepAliveInterval is left zero
+const defaultKeepAliveInterval = 30 * time.Second
+
+// SlowPeerPolicy controls what enqueue does when a peer's outbox is full
+type SlowPeerPolicy int
+
+const (
+	// DropFrame discards the frame and logs a warning, leaving the peer connected
+	DropFrame SlowPeerPolicy = iota
+	// DisconnectPeer removes the peer and closes the connection via removePeer
+	DisconnectPeer
+)
+
+// Code identifies the kind of a framed message
+type Code uint8
+
+const (
+	CodeChat Code = iota
+	CodePing
+	CodePong
+	CodeNick
+	CodeJoin
+	CodeLeave
+	CodeDisconnect
+	CodePublish
 )
 
 // Message received in a Read() loop
 type Message struct {
-	data []byte // value received from a buffer
-	from string // stringfied address from the sender
+	code     Code           // opcode identifying the kind of message
+	payload  []byte         // value received from a buffer
+	from     string         // stringfied address from the sender
+	identity ClientIdentity // identity resolved for the sender during its handshake
+	conn     net.Conn
+}
+
+// peerState tracks everything the server knows about a connection beyond the socket itself
+type peerState struct {
+	identity ClientIdentity
+	channels map[string]struct{}
+	outbox   chan []byte // bounded queue drained by a per-connection writer goroutine
+}
+
+// Returns an initialized instance of *peerState
+func newPeerState() *peerState {
+	return &peerState{
+		channels: make(map[string]struct{}),
+		outbox:   make(chan []byte, outboxCapacity),
+	}
+}
+
+// connection pairs an accepted net.Conn with the ClientIdentity resolved during its handshake and
+// the *bufio.Reader the handshake read it through, so readMsgLoop picks up exactly where the
+// handshake left off instead of losing whatever it had already buffered from the socket.
+type connection struct {
+	conn     net.Conn
+	identity ClientIdentity
+	reader   *bufio.Reader
 }
 
 // Peer is a group of connections with channels for adding/removing connections
 type Peer struct {
-	list map[net.Conn]struct{}
-	add  chan net.Conn
+	list map[net.Conn]*peerState
+	add  chan *connection
 	del  chan net.Conn
 }
 
+// peerChanCapacity is the buffer size for peers.add/peers.del so one slow case in selectLoop
+// doesn't stall accepts and disconnects that are independent of it
+const peerChanCapacity = 16
+
 // Returns an initialized instance of *Peer
 func NewPeer() *Peer {
 	return &Peer{
-		list: make(map[net.Conn]struct{}),
-		add:  make(chan net.Conn),
-		del:  make(chan net.Conn),
+		list: make(map[net.Conn]*peerState),
+		add:  make(chan *connection, peerChanCapacity),
+		del:  make(chan net.Conn, peerChanCapacity),
 	}
 }
 
+// publishRequest carries a Server.Broadcast call into the selectLoop
+type publishRequest struct {
+	channelID string
+	data      []byte
+}
+
 // Server that handles messages for a group of connections
 type Server struct {
 	ln       net.Listener
 	peers    *Peer
 	msg      chan Message
 	shutdown chan os.Signal
+	hup      chan os.Signal
+
+	// peersWG tracks connections currently in peers.list, so acceptLoop can wait for them to
+	// drain naturally after a zero-downtime upgrade closes the listener.
+	peersWG sync.WaitGroup
+	// upgrading is set once a re-exec'd child has signalled readiness, telling acceptLoop that
+	// the listener closing means "hand off complete" rather than "shut down".
+	upgrading atomic.Bool
+
+	// MaxFrameSize caps the body size accepted for a single frame, rejecting anything larger.
+	// Defaults to defaultMaxFrameSize when left zero.
+	MaxFrameSize uint32
+
+	// SlowPeerPolicy decides what happens to a peer whose outbox is full. Defaults to DropFrame.
+	SlowPeerPolicy SlowPeerPolicy
+
+	// ReadIdleTimeout bounds how long a connection may go without sending a frame before the
+	// server pings it; if no pong arrives within a second such window, the peer is disconnected.
+	// Defaults to defaultReadIdleTimeout when left zero.
+	ReadIdleTimeout time.Duration
+	// WriteTimeout bounds how long a writer goroutine waits for a single frame write.
+	// Defaults to defaultWriteTimeout when left zero.
+	WriteTimeout time.Duration
+	// KeepAliveInterval configures the TCP keepalive probe period on accepted connections.
+	// Defaults to defaultKeepAliveInterval when left zero.
+	KeepAliveInterval time.Duration
+
+	channels      map[string]*Channel
+	createChannel chan string
+	publish       chan publishRequest
+	channelsQuery chan chan []string
 }
 
 // Returns an initialized instance of *Server
 // sets up a signal for shutdown
 func NewServer() (s *Server) {
 	s = &Server{
-		peers:    NewPeer(),
-		msg:      make(chan Message),
-		shutdown: make(chan os.Signal),
+		peers:         NewPeer(),
+		msg:           make(chan Message, peerChanCapacity),
+		shutdown:      make(chan os.Signal),
+		hup:           make(chan os.Signal, 1),
+		MaxFrameSize:  defaultMaxFrameSize,
+		channels:      make(map[string]*Channel),
+		createChannel: make(chan string),
+		publish:       make(chan publishRequest),
+		channelsQuery: make(chan chan []string),
 	}
 	signal.Notify(s.shutdown, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(s.hup, syscall.SIGHUP)
 	return
 }
 
-// Starts the server listening, the selectLoop goroutine and an acceptLoop
+// Starts the server listening, the selectLoop goroutine and an acceptLoop.
+// If TCP_SERVER_LISTENER_FD is set, this process is a zero-downtime upgrade child: it inherits
+// the listener fd instead of binding address, and signals its parent once it's ready to serve.
 func (s *Server) Start(address string) error {
+	if ln, ok, err := inheritedListener(); err != nil {
+		return err
+	} else if ok {
+		slog.Info("inherited listener from parent", "ppid", os.Getenv(ppidEnv))
+		if err := notifyParentReady(); err != nil {
+			slog.Warn("failed to notify parent of readiness", "err", err)
+		}
+		return s.serve(ln)
+	}
+
 	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
+	return s.serve(ln)
+}
+
+// StartTLS is like Start but wraps the listener with TLS using cfg. Every accepted connection
+// still goes through the identity handshake in handleConnection on top of the TLS handshake.
+func (s *Server) StartTLS(address string, cfg *tls.Config) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	// tls.Conn doesn't expose the *net.TCPConn it wraps, so acceptLoop's type assertion can never
+	// reach it; apply keepalive to the raw connection here, before tls.NewListener wraps it.
+	return s.serve(tls.NewListener(&keepAliveListener{Listener: ln, interval: s.keepAliveInterval()}, cfg))
+}
+
+// keepAliveListener applies TCP keepalive to every connection as it's accepted, before handing it
+// off to a wrapping listener (e.g. tls.NewListener) that would otherwise obscure the *net.TCPConn.
+type keepAliveListener struct {
+	net.Listener
+	interval time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(l.interval)
+	}
+	return conn, nil
+}
+
+// serve stores ln, starts the selectLoop goroutine and runs acceptLoop, shared by Start and StartTLS
+func (s *Server) serve(ln net.Listener) error {
 	s.ln = ln
 
 	go s.selectLoop()
 
-	slog.Info("tcp server started", "port", address)
+	slog.Info("tcp server started", "addr", ln.Addr())
 
-	if err := s.acceptLoop(); err != nil {
-		return err
-	}
-	return nil
+	return s.acceptLoop()
 }
 
-// Accepts and handles incoming connections in a loop
+// Accepts and handles incoming connections in a loop.
+// If the listener closed because a zero-downtime upgrade handed off to a child, this waits for
+// existing peers to disconnect naturally before returning, instead of exiting immediately.
 func (s *Server) acceptLoop() error {
 	for {
 		conn, err := s.ln.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
+				if s.upgrading.Load() {
+					slog.Info("upgrade handed off, waiting for existing peers to disconnect")
+					s.peersWG.Wait()
+				}
 				return nil
 			}
 			fmt.Println("err =>", err.Error())
 			continue
 		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(s.keepAliveInterval())
+		}
 		go s.handleConnection(conn)
 	}
 }
 
 // Handles receiving channels
-// All channels are unbuffered so cases block each other
+// peers.add/peers.del/msg are modestly buffered so a burst on one doesn't stall the others
 func (s *Server) selectLoop() {
 	for {
 		select {
-		case conn := <-s.peers.del: // removes conn from peers.list
-			slog.Info("peer disconnected", "addr", conn.RemoteAddr())
-			delete(s.peers.list, conn)
-			conn.Close()
+		case conn := <-s.peers.del: // removes conn from peers.list and from every channel it had joined
+			s.removePeer(conn)
 		case msg := <-s.msg: // receives and handles a Message
 			if err := s.handleMessage(msg); err != nil {
 				fmt.Println(err)
 			}
-		case conn := <-s.peers.add: // adds an incoming connection to peers.list, starts a read loop for that connection
-			slog.Info("new peer connected", "addr", conn.RemoteAddr())
-			s.peers.list[conn] = struct{}{}
-			go s.readMsgLoop(conn)
+		case c := <-s.peers.add: // adds an incoming connection to peers.list, starts a read loop and a writer goroutine
+			slog.Info("new peer connected", "addr", c.conn.RemoteAddr(), "identity", c.identity)
+			ps := newPeerState()
+			ps.identity = c.identity
+			s.peers.list[c.conn] = ps
+			s.peersWG.Add(1)
+			go s.readMsgLoop(c.conn, c.identity, c.reader)
+			go s.writePump(c.conn, ps.outbox)
+		case sig := <-s.hup: // starts a zero-downtime upgrade: re-exec with the listener fd handed to the child
+			slog.Info("received signal, upgrading", "signal", sig)
+			if err := s.upgrade(); err != nil {
+				slog.Error("upgrade failed, continuing to serve", "err", err)
+				break
+			}
+			go s.awaitChildReady()
+		case id := <-s.createChannel: // creates a channel if it doesn't already exist
+			s.getOrCreateChannel(id)
+		case req := <-s.publish: // broadcasts data to a channel on behalf of an embedder, not tied to a connection
+			envelope, err := encodeChannelEnvelope(req.channelID, req.data)
+			if err != nil {
+				fmt.Println(err)
+				break
+			}
+			s.broadcastToChannel(req.channelID, envelope, nil)
+		case resp := <-s.channelsQuery: // answers a Channels() call with the current channel ids
+			ids := make([]string, 0, len(s.channels))
+			for id := range s.channels {
+				ids = append(ids, id)
+			}
+			resp <- ids
 		case signal := <-s.shutdown: // on interrupt: closes the connections in peers.list, closes the server listener
 			for peer := range s.peers.list {
 				peer.Close()
@@ -113,40 +319,288 @@ func (s *Server) selectLoop() {
 	}
 }
 
-// Reads incoming messages in a loop
+// removePeer deletes conn from peers.list and from every channel it had joined, closing its
+// outbox so writePump returns. Only ever called from within selectLoop's own goroutine, so it
+// must never itself block sending to s.peers.del (see the CodeDisconnect case in handleMessage).
+func (s *Server) removePeer(conn net.Conn) {
+	if ps, ok := s.peers.list[conn]; ok {
+		slog.Info("peer disconnected", "addr", conn.RemoteAddr(), "identity", ps.identity)
+		for chID := range ps.channels {
+			if ch, ok := s.channels[chID]; ok {
+				delete(ch.members, conn)
+			}
+		}
+		close(ps.outbox)
+		s.peersWG.Done()
+	}
+	delete(s.peers.list, conn)
+	conn.Close()
+}
+
+// maxFrameSize returns s.MaxFrameSize, falling back to defaultMaxFrameSize when unset
+func (s *Server) maxFrameSize() uint32 {
+	if s.MaxFrameSize == 0 {
+		return defaultMaxFrameSize
+	}
+	return s.MaxFrameSize
+}
+
+// readIdleTimeout returns s.ReadIdleTimeout, falling back to defaultReadIdleTimeout when unset
+func (s *Server) readIdleTimeout() time.Duration {
+	if s.ReadIdleTimeout == 0 {
+		return defaultReadIdleTimeout
+	}
+	return s.ReadIdleTimeout
+}
+
+// writeTimeout returns s.WriteTimeout, falling back to defaultWriteTimeout when unset
+func (s *Server) writeTimeout() time.Duration {
+	if s.WriteTimeout == 0 {
+		return defaultWriteTimeout
+	}
+	return s.WriteTimeout
+}
+
+// keepAliveInterval returns s.KeepAliveInterval, falling back to defaultKeepAliveInterval when unset
+func (s *Server) keepAliveInterval() time.Duration {
+	if s.KeepAliveInterval == 0 {
+		return defaultKeepAliveInterval
+	}
+	return s.KeepAliveInterval
+}
+
+// readFrame reads a single [length][code][payload] frame from r, validating length against max
+func readFrame(r *bufio.Reader, max uint32) (Code, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	code := Code(header[4])
+	if length > max {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds max frame size %d", length, max)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return code, payload, nil
+}
+
+// buildFrame encodes a [length][code][payload] frame ready to write to a conn
+func buildFrame(code Code, payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	frame[4] = byte(code)
+	copy(frame[frameHeaderSize:], payload)
+	return frame
+}
+
+// writeFrame writes a [length][code][payload] frame to conn, the symmetric counterpart to readFrame.
+// Used directly for the handshake, which runs before a connection has an outbox to enqueue onto.
+func writeFrame(conn net.Conn, code Code, payload []byte) error {
+	_, err := conn.Write(buildFrame(code, payload))
+	return err
+}
+
+// writePump drains outbox onto conn until it's closed, applying a write deadline to every frame
+// so a stuck TCP send eventually errors out instead of hanging the writer goroutine forever.
+// On a write error it disconnects the peer via s.peers.del.
+func (s *Server) writePump(conn net.Conn, outbox chan []byte) {
+	for frame := range outbox {
+		conn.SetWriteDeadline(time.Now().Add(s.writeTimeout()))
+		if _, err := conn.Write(frame); err != nil {
+			fmt.Println("write() error:", err)
+			s.peers.del <- conn
+			return
+		}
+	}
+}
+
+// enqueue non-blocking-sends a frame onto conn's outbox. If the outbox is full, it either drops
+// the frame or disconnects the peer per s.SlowPeerPolicy, rather than blocking the caller.
+func (s *Server) enqueue(conn net.Conn, code Code, payload []byte) {
+	ps, ok := s.peers.list[conn]
+	if !ok {
+		return
+	}
+	select {
+	case ps.outbox <- buildFrame(code, payload):
+	default:
+		if s.SlowPeerPolicy == DisconnectPeer {
+			slog.Warn("disconnecting slow peer", "addr", conn.RemoteAddr())
+			// enqueue is only ever called from within selectLoop's own goroutine (via
+			// handleMessage or broadcastToChannel), which is also the sole consumer of s.peers.del: a blocking
+			// send here would wedge selectLoop against its own channel, same as the
+			// CodeDisconnect case removePeer exists for. Remove the peer inline instead.
+			s.removePeer(conn)
+			return
+		}
+		slog.Warn("dropping frame for slow peer", "addr", conn.RemoteAddr(), "code", code)
+	}
+}
+
+// Reads incoming framed messages in a loop, enforcing s.ReadIdleTimeout as an idle connection
+// deadline. The first timeout pings the peer directly and gives it one more ReadIdleTimeout
+// window to reply with a pong; a second timeout with no pong disconnects it, catching half-open
+// TCP connections that would otherwise sit in peers.list forever.
 // Sends a Message through the s.msg channel when successful
-// Sends a net.Conn through the s.peers.del channel when Read(buf) errs, then returns
-func (s *Server) readMsgLoop(conn net.Conn) {
-	buf := make([]byte, 1024)
+// Sends a net.Conn through the s.peers.del channel when a read errs, then returns
+// r is the *bufio.Reader the handshake used, reused here so bytes it had already buffered past
+// the hello frame (e.g. a pipelined first message) aren't dropped by starting a fresh reader.
+func (s *Server) readMsgLoop(conn net.Conn, identity ClientIdentity, r *bufio.Reader) {
+	awaitingPong := false
 	for {
-		n, err := conn.Read(buf)
+		conn.SetReadDeadline(time.Now().Add(s.readIdleTimeout()))
+		code, payload, err := readFrame(r, s.maxFrameSize())
 		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if awaitingPong {
+					fmt.Println("read() error: idle timeout, peer did not reply to ping")
+					s.peers.del <- conn
+					return
+				}
+				awaitingPong = true
+				if err := writeFrame(conn, CodePing, nil); err != nil {
+					fmt.Println("write() error:", err)
+					s.peers.del <- conn
+					return
+				}
+				continue
+			}
 			fmt.Println("read() error:", err)
 			s.peers.del <- conn
 			return
 		}
+		// Any successfully-read frame is proof of life, not just a pong: a peer that's been
+		// actively chatting should never carry a stale awaitingPong into its next idle window.
+		awaitingPong = false
+		if code == CodePong {
+			continue
+		}
 		s.msg <- Message{
-			data: buf[:n],
-			from: conn.RemoteAddr().String(),
+			code:     code,
+			payload:  payload,
+			from:     conn.RemoteAddr().String(),
+			identity: identity,
+			conn:     conn,
 		}
 	}
 }
 
-// Resends the incoming Message to the other connections in s.peers.list
+// Dispatches msg by its code: chat is rebroadcast, ping is answered with a pong,
+// join/leave update channel membership, publish fans out to channel subscribers,
+// disconnect removes the sender from peers.list
 func (s *Server) handleMessage(msg Message) error {
-	fmt.Printf("%s\n", string(msg.data))
-	for peer := range s.peers.list {
-		if peer.RemoteAddr().String() != msg.from {
-			peer.Write(msg.data)
+	switch msg.code {
+	case CodeChat:
+		fmt.Printf("%s\n", string(msg.payload))
+		for peer, ps := range s.peers.list {
+			if !identityEquals(ps.identity, msg.identity) {
+				s.enqueue(peer, CodeChat, msg.payload)
+			}
+		}
+	case CodePing:
+		s.enqueue(msg.conn, CodePong, nil)
+	case CodeJoin:
+		ps, ok := s.peers.list[msg.conn]
+		if !ok {
+			return nil
+		}
+		id, _, err := decodeChannelEnvelope(msg.payload)
+		if err != nil {
+			return err
 		}
+		s.getOrCreateChannel(id).members[msg.conn] = struct{}{}
+		ps.channels[id] = struct{}{}
+	case CodeLeave:
+		ps, ok := s.peers.list[msg.conn]
+		if !ok {
+			return nil
+		}
+		id, _, err := decodeChannelEnvelope(msg.payload)
+		if err != nil {
+			return err
+		}
+		if ch, ok := s.channels[id]; ok {
+			delete(ch.members, msg.conn)
+		}
+		delete(ps.channels, id)
+	case CodePublish:
+		id, _, err := decodeChannelEnvelope(msg.payload)
+		if err != nil {
+			return err
+		}
+		s.broadcastToChannel(id, msg.payload, msg.conn)
+	case CodeDisconnect:
+		// handleMessage runs inside selectLoop itself, which is the sole consumer of
+		// s.peers.del: a blocking send here would wedge selectLoop against its own channel
+		// once peerChanCapacity disconnects are in flight. Remove the peer inline instead.
+		s.removePeer(msg.conn)
+	default:
+		return fmt.Errorf("unhandled message code: %d", msg.code)
 	}
 	return nil
 }
 
-// Sends conn through the s.peers.add channel
+// getOrCreateChannel returns the channel for id, creating it if it doesn't exist yet.
+// Only ever called from selectLoop, so no synchronization is needed.
+func (s *Server) getOrCreateChannel(id string) *Channel {
+	ch, ok := s.channels[id]
+	if !ok {
+		ch = NewChannel(id)
+		s.channels[id] = ch
+	}
+	return ch
+}
+
+// broadcastToChannel enqueues a CodePublish frame with envelope for every member of channelID
+// except skip, which is nil when the broadcast didn't originate from a peer
+func (s *Server) broadcastToChannel(channelID string, envelope []byte, skip net.Conn) {
+	ch, ok := s.channels[channelID]
+	if !ok {
+		return
+	}
+	for conn := range ch.members {
+		if conn == skip {
+			continue
+		}
+		s.enqueue(conn, CodePublish, envelope)
+	}
+}
+
+// CreateChannel creates a named channel if it doesn't already exist, so embedders
+// can set up channels without waiting for a client to join one first
+func (s *Server) CreateChannel(id string) {
+	s.createChannel <- id
+}
+
+// Broadcast publishes data to every peer currently subscribed to channelID
+func (s *Server) Broadcast(channelID string, data []byte) {
+	s.publish <- publishRequest{channelID: channelID, data: data}
+}
+
+// Channels returns the ids of every channel that currently exists
+func (s *Server) Channels() []string {
+	resp := make(chan []string)
+	s.channelsQuery <- resp
+	return <-resp
+}
+
+// Runs the identity handshake on conn and, on success, sends it through the s.peers.add channel.
+// Connections that fail the handshake are closed and never reach peers.list.
 func (s *Server) handleConnection(conn net.Conn) {
-	s.peers.add <- conn
-	fmt.Printf("handling connection addr=%v\n", conn.RemoteAddr())
+	identity, r, err := handshake(conn, s.maxFrameSize())
+	if err != nil {
+		slog.Warn("handshake failed", "addr", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	s.peers.add <- &connection{conn: conn, identity: identity, reader: r}
+	fmt.Printf("handling connection addr=%v identity=%v\n", conn.RemoteAddr(), identity)
 }
 
 func main() {
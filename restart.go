@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// listenerFDEnv and ppidEnv are the environment variables used to pass an inherited listener fd
+// and the parent's pid to a child process across a self-reexec upgrade
+const (
+	listenerFDEnv = "TCP_SERVER_LISTENER_FD"
+	ppidEnv       = "TCP_SERVER_PPID"
+
+	// inheritedListenerFD is the fd slot a child finds its inherited listener on: right after
+	// the stdin/stdout/stderr fds, which are always forwarded ahead of it.
+	inheritedListenerFD = 3
+)
+
+// inheritedListener reconstructs the listener passed down by a parent process during a
+// self-reexec upgrade. ok is false when the process wasn't started as an upgrade child.
+func inheritedListener() (ln net.Listener, ok bool, err error) {
+	if os.Getenv(listenerFDEnv) == "" {
+		return nil, false, nil
+	}
+	ln, err = net.FileListener(os.NewFile(inheritedListenerFD, "listener"))
+	if err != nil {
+		return nil, false, err
+	}
+	return ln, true, nil
+}
+
+// notifyParentReady signals TCP_SERVER_PPID with SIGUSR2, telling the parent process that
+// spawned us that we're serving and it can stop accepting new connections.
+func notifyParentReady() error {
+	ppid, err := strconv.Atoi(os.Getenv(ppidEnv))
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", ppidEnv, err)
+	}
+	proc, err := os.FindProcess(ppid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(syscall.SIGUSR2)
+}
+
+// upgrade re-execs the running binary, handing the listener's underlying file descriptor to the
+// child via TCP_SERVER_LISTENER_FD so it can accept on the same address. Active net.Conns in
+// s.peers.list are unaffected by this: only the listener fd is transferred, never a peer's.
+func (s *Server) upgrade() error {
+	tcpLn, ok := s.ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("upgrade: listener of type %T cannot be inherited", s.ln)
+	}
+	listenerFile, err := tcpLn.File()
+	if err != nil {
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	defer listenerFile.Close()
+
+	env := append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenerFDEnv, inheritedListenerFD),
+		fmt.Sprintf("%s=%d", ppidEnv, os.Getpid()),
+	)
+
+	_, err = os.StartProcess(os.Args[0], os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, listenerFile},
+	})
+	return err
+}
+
+// awaitChildReady blocks until the freshly re-exec'd child signals SIGUSR2, then stops s from
+// accepting further connections. Existing peers are left running; acceptLoop waits for them to
+// disconnect naturally before letting Start return.
+func (s *Server) awaitChildReady() {
+	ready := make(chan os.Signal, 1)
+	signal.Notify(ready, syscall.SIGUSR2)
+	<-ready
+	slog.Info("child is ready, closing listener")
+	s.upgrading.Store(true)
+	s.ln.Close()
+}